@@ -4,9 +4,9 @@
 package alice
 
 import (
+	"context"
+	"fmt"
 	"net/http"
-
-	"code.google.com/p/go.net/context"
 )
 
 // A constructor for a piece of middleware, also for the final method called by .Then
@@ -16,12 +16,21 @@ type CtxHandler interface {
 	ServeHTTP(context.Context, http.ResponseWriter, *http.Request)
 }
 
+// Context is an alias for the standard-library context.Context, which this
+// package uses in place of code.google.com/p/go.net/context (now defunct
+// along with Google Code).
+// New code should use context.Context directly.
+type Context = context.Context
+
 // Chain acts as a list of http.Handler constructors.
 // Chain is effectively immutable:
 // once created, it will always hold
 // the same set of constructors in the same order.
 type Chain struct {
 	constructors []Constructor
+	// ctx is the base context used for a request that doesn't already carry
+	// one of its own. See WithContext.
+	ctx context.Context
 }
 
 // New creates a new chain,
@@ -29,12 +38,26 @@ type Chain struct {
 // New serves no other function,
 // constructors are only called upon a call to Then().
 func New(constructors ...Constructor) Chain {
-	c := Chain{}
+	c := Chain{ctx: context.TODO()}
 	c.constructors = append(c.constructors, constructors...)
 
 	return c
 }
 
+// WithContext returns a new chain that uses ctx as the base context for
+// requests whose *http.Request doesn't already carry one of its own (see
+// http.Request.WithContext). It does not affect requests that do carry a
+// context: those are always built and served with their own, per-request
+// context so that deadlines, cancellation and request-scoped values flow
+// through the whole chain.
+//
+//     stdChain := alice.New(m1, m2).WithContext(rootCtx)
+func (c Chain) WithContext(ctx context.Context) Chain {
+	newChain := c
+	newChain.ctx = ctx
+	return newChain
+}
+
 // Then chains the middleware and returns the final http.Handler.
 //     New(m1, m2, m3).Then(h)
 // is equivalent to:
@@ -43,63 +66,73 @@ func New(constructors ...Constructor) Chain {
 // and finally, the given handler
 // (assuming every middleware calls the following one).
 //
+// Unlike earlier versions of this package, the constructors are not run once
+// at Then() time. Instead, the returned http.Handler builds and runs the
+// chain on every request, using the context from r.Context() (falling back
+// to the chain's base context, see WithContext, for requests that don't
+// carry one of their own). This means deadlines, cancellation and
+// request-scoped values set on the incoming *http.Request propagate all the
+// way through the chain.
+//
 // A chain can be safely reused by calling Then() several times.
 //     stdStack := alice.New(ratelimitHandler, csrfHandler)
 //     indexPipe = stdStack.Then(indexHandler)
 //     authPipe = stdStack.Then(authHandler)
-// Note that constructors are called on every call to Then()
+// Note that constructors are called on every request
 // and thus several instances of the same middleware will be created
 // when a chain is reused in this way.
 // For proper middleware, this should cause no problems.
 //
 // nil is not allowed for Then()
-func (c Chain) Then(h CtxHandler) (wrappedFinal http.Handler) {
-	var final CtxHandler
-
-	ctx := context.TODO()
-
-	if h != nil {
-		final = h
-	} else {
+func (c Chain) Then(h CtxHandler) http.Handler {
+	if h == nil {
 		panic("nil is not allowed")
 	}
 
-	for i := len(c.constructors) - 1; i >= 0; i-- {
-		final = c.constructors[i](ctx, final)
-	}
-	wrappedFinal = http.HandlerFunc(CtxHandlerToHandlerFunc(ctx, final))
-	return
+	return http.HandlerFunc(CtxHandlerToHandlerFunc(c.ctx, c.ThenContext(h)))
 }
 
-// Same as Then, but with CtxHandler instead of wrapped-http-Handler
-func (c Chain) ThenContext(h CtxHandler) (final CtxHandler) {
-
-	ctx := context.TODO()
-
-	if h != nil {
-		final = h
-	} else {
+// Same as Then, but with CtxHandler instead of wrapped-http-Handler.
+//
+// The constructors are invoked per-request, with the ctx passed to
+// ServeHTTP, rather than once when ThenContext is called.
+func (c Chain) ThenContext(h CtxHandler) CtxHandler {
+	if h == nil {
 		panic("nil is not allowed")
 	}
 
-	for i := len(c.constructors) - 1; i >= 0; i-- {
-		final = c.constructors[i](ctx, final)
-	}
-	return
+	return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		final := h
+
+		for i := len(c.constructors) - 1; i >= 0; i-- {
+			final = c.constructors[i](ctx, final)
+		}
+		final.ServeHTTP(ctx, w, r)
+	})
 }
 
 // Same as ThenFunc, but with CtxHandler instead of wrapped-http-Handler
 func (c Chain) ThenFuncContext(fn CtxHandlerFunc) (final CtxHandler) {
 
 	if fn == nil {
-		return c.Then(nil)
+		return c.ThenContext(nil)
 	}
 
 	return c.ThenContext(CtxHandlerFunc(fn))
 }
 
-func CtxHandlerToHandlerFunc(ctx context.Context, fn CtxHandler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) { fn.ServeHTTP(ctx, w, r) }
+// CtxHandlerToHandlerFunc adapts a CtxHandler into a plain http.HandlerFunc.
+// On each request, the ctx passed to fn is taken from r.Context(), falling
+// back to baseCtx for requests that don't carry one of their own (for those,
+// r.Context() reports context.Background()).
+func CtxHandlerToHandlerFunc(baseCtx context.Context, fn CtxHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if ctx == nil || ctx == context.Background() {
+			ctx = baseCtx
+		}
+		fn.ServeHTTP(ctx, w, r)
+	}
 }
 
 // ThenFunc works identically to Then, but takes
@@ -133,10 +166,113 @@ func (c Chain) Append(constructors ...Constructor) Chain {
 	newCons = append(newCons, constructors...)
 
 	newChain := New(newCons...)
+	newChain.ctx = c.ctx
 	return newChain
 }
 
+// Extend returns a new chain consisting of the constructors in c followed by
+// the constructors in other, leaving both original chains untouched. The
+// base context of c (see WithContext) carries over to the returned chain.
+//
+//     authStack := alice.New(m1, m2)
+//     apiStack := alice.New(m3, m4)
+//     combined := authStack.Extend(apiStack)
+//     // requests in combined go m1 -> m2 -> m3 -> m4
+func (c Chain) Extend(other Chain) Chain {
+	return c.Append(other.constructors...)
+}
+
+// Use appends middleware of varying signatures to the chain and returns a
+// new chain, leaving the original untouched, following the same
+// copy-on-write semantics as Append. Each argument in handlers must be one
+// of:
+//
+//   - Constructor, or equivalently func(context.Context, CtxHandler) CtxHandler
+//   - func(CtxHandler) CtxHandler, for context-agnostic middleware
+//   - func(http.Handler) http.Handler, adapted via Wrap
+//   - http.Handler or CtxHandler, used as a terminal handler that ignores
+//     the rest of the chain (mirroring what Then does with its argument) —
+//     only valid as the last argument, since it strands anything after it
+//
+// Use panics with a message naming the offending type if passed a value that
+// doesn't match any of the above, mirroring the strictness of xhandler's
+// Chain.Add. It also panics if a terminal http.Handler/CtxHandler is passed
+// anywhere but last, since any middleware after it would silently never run.
+//
+//     stdChain := alice.New().Use(m1, gziphandler.GzipHandler, m2)
+func (c Chain) Use(handlers ...interface{}) Chain {
+	constructors := make([]Constructor, 0, len(handlers))
+
+	for i, h := range handlers {
+		switch v := h.(type) {
+		case Constructor:
+			constructors = append(constructors, v)
+		case func(context.Context, CtxHandler) CtxHandler:
+			constructors = append(constructors, v)
+		case func(CtxHandler) CtxHandler:
+			constructors = append(constructors, func(_ context.Context, next CtxHandler) CtxHandler {
+				return v(next)
+			})
+		case func(http.Handler) http.Handler:
+			constructors = append(constructors, Wrap(v))
+		case http.Handler:
+			if i != len(handlers)-1 {
+				panic(fmt.Sprintf("alice: Use: terminal http.Handler at position %d would strand %d subsequent middleware", i, len(handlers)-1-i))
+			}
+			constructors = append(constructors, terminal(CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				v.ServeHTTP(w, r)
+			})))
+		case CtxHandler:
+			if i != len(handlers)-1 {
+				panic(fmt.Sprintf("alice: Use: terminal CtxHandler at position %d would strand %d subsequent middleware", i, len(handlers)-1-i))
+			}
+			constructors = append(constructors, terminal(v))
+		default:
+			panic(fmt.Sprintf("alice: Use: unsupported middleware type %T", h))
+		}
+	}
+
+	return c.Append(constructors...)
+}
+
+// terminal returns a Constructor that always serves h regardless of next,
+// letting a bare handler passed to Use end the chain the way Then's argument
+// does.
+func terminal(h CtxHandler) Constructor {
+	return func(ctx context.Context, next CtxHandler) CtxHandler {
+		return h
+	}
+}
+
 // ServeHTTP calls f(ctx,w, r).
 func (f CtxHandlerFunc) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	f(ctx, w, r)
 }
+
+// Wrap adapts a plain http.Handler middleware (the common
+// func(http.Handler) http.Handler shape used by e.g. logging, gzip, CSRF and
+// security-header libraries) into a Constructor that can be mixed into a
+// Chain alongside context-aware middleware.
+//
+// The ctx passed to the returned CtxHandler's ServeHTTP is stored on the
+// *http.Request (via r.WithContext) before mw runs, so mw observes it through
+// r.Context() like any other net/http middleware. The bridge then reads the
+// context back off the request when calling next, so that if mw itself
+// derives a new context (e.g. r = r.WithContext(ctx2), the idiomatic way to
+// attach request-scoped values), the next CtxHandler in the chain sees that
+// derived context too instead of the one it was called with.
+//
+//     stdChain := alice.New(alice.Wrap(gziphandler.GzipHandler), myCtxConstructor)
+func Wrap(mw func(http.Handler) http.Handler) Constructor {
+	return func(ctx context.Context, next CtxHandler) CtxHandler {
+		bridge := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(r.Context(), w, r)
+		})
+
+		wrapped := mw(bridge)
+
+		return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			wrapped.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
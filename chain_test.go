@@ -0,0 +1,182 @@
+package alice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestThenPropagatesRequestContextCancellation verifies that cancelling the
+// context on an incoming *http.Request is observed by middleware further
+// down the chain, rather than every request sharing one base context.TODO()
+// captured at Then() time.
+func TestThenPropagatesRequestContextCancellation(t *testing.T) {
+	passThrough := func(_ context.Context, next CtxHandler) CtxHandler {
+		return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(ctx, w, r)
+		})
+	}
+
+	canceled := make(chan struct{}, 1)
+	final := CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-ctx.Done():
+			canceled <- struct{}{}
+		case <-time.After(time.Second):
+		}
+	})
+
+	h := New(passThrough).Then(final)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case <-canceled:
+	default:
+		t.Fatal("expected cancellation of the request context to propagate to middleware")
+	}
+}
+
+// TestWrapObservesRequestScopedContextValues verifies that a plain
+// http.Handler middleware wrapped via Wrap can attach a value to the request
+// context the idiomatic way (r.WithContext) and have it reach the next
+// CtxHandler in the chain, rather than that handler only ever seeing the ctx
+// that was in effect when the Constructor was built.
+func TestWrapObservesRequestScopedContextValues(t *testing.T) {
+	type key struct{}
+
+	mw := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), key{}, "injected")))
+		})
+	}
+
+	var got interface{}
+	final := CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		got = ctx.Value(key{})
+	})
+
+	h := New(Wrap(mw)).Then(final)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got != "injected" {
+		t.Fatalf("expected downstream CtxHandler to see value injected via r.WithContext, got %v", got)
+	}
+}
+
+// TestExtend verifies that Extend runs c's constructors before other's,
+// and that both original chains are left untouched by the combination.
+func TestExtend(t *testing.T) {
+	var calls []string
+
+	record := func(name string) Constructor {
+		return func(_ context.Context, next CtxHandler) CtxHandler {
+			return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(ctx, w, r)
+			})
+		}
+	}
+
+	final := CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "final")
+	})
+
+	c := New(record("m1"), record("m2"))
+	other := New(record("m3"), record("m4"))
+
+	combined := c.Extend(other)
+
+	h := combined.Then(final)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := []string{"m1", "m2", "m3", "m4", "final"}
+	if len(calls) != len(want) {
+		t.Fatalf("call order = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("call order = %v, want %v", calls, want)
+		}
+	}
+
+	if len(c.constructors) != 2 {
+		t.Fatalf("c.constructors mutated by Extend: len = %d, want 2", len(c.constructors))
+	}
+	if len(other.constructors) != 2 {
+		t.Fatalf("other.constructors mutated by Extend: len = %d, want 2", len(other.constructors))
+	}
+
+	calls = nil
+	c.Then(final).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if want := []string{"m1", "m2", "final"}; len(calls) != len(want) || calls[0] != want[0] || calls[1] != want[1] || calls[2] != want[2] {
+		t.Fatalf("c was affected by Extend: calls = %v, want %v", calls, want)
+	}
+}
+
+// TestUsePanicsOnStrandedTerminalHandler verifies that Use refuses to
+// silently strand middleware listed after a terminal http.Handler/CtxHandler,
+// since such middleware would otherwise never run without any indication why.
+func TestUsePanicsOnStrandedTerminalHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Use to panic when a terminal handler is not the last argument")
+		}
+	}()
+
+	terminal := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	strandedConstructor := func(_ context.Context, next CtxHandler) CtxHandler { return next }
+
+	New().Use(terminal, strandedConstructor)
+}
+
+// TestUseRunsHeterogeneousMiddlewareInOrder verifies that a Constructor, a
+// func(CtxHandler) CtxHandler and a func(http.Handler) http.Handler passed to
+// a single Use call are all adapted correctly and run in argument order.
+func TestUseRunsHeterogeneousMiddlewareInOrder(t *testing.T) {
+	var calls []string
+
+	ctxConstructor := func(_ context.Context, next CtxHandler) CtxHandler {
+		return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "ctxConstructor")
+			next.ServeHTTP(ctx, w, r)
+		})
+	}
+
+	ctxAgnostic := func(next CtxHandler) CtxHandler {
+		return CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "ctxAgnostic")
+			next.ServeHTTP(ctx, w, r)
+		})
+	}
+
+	plain := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls = append(calls, "plain")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	final := CtxHandlerFunc(func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "final")
+	})
+
+	h := New().Use(ctxConstructor, ctxAgnostic, plain).Then(final)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := []string{"ctxConstructor", "ctxAgnostic", "plain", "final"}
+	if len(calls) != len(want) {
+		t.Fatalf("call order = %v, want %v", calls, want)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("call order = %v, want %v", calls, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Package fasthttp provides the same Chain API as the parent alice package,
+// but for github.com/valyala/fasthttp.RequestHandler instead of net/http.
+// Constructors have the shape func(context.Context, fasthttp.RequestHandler)
+// fasthttp.RequestHandler, and the base/per-request context is threaded
+// through fasthttp.RequestCtx via SetUserValue/UserValue since RequestCtx
+// has no equivalent of http.Request.Context().
+package fasthttp
+
+import (
+	"context"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ctxKey is the RequestCtx user-value key under which the per-request
+// context.Context is stored once a chain has started serving a request.
+type ctxKey struct{}
+
+// A Constructor for a piece of fasthttp middleware, also for the final
+// handler called by Then. Mirrors alice.Constructor.
+type Constructor func(context.Context, fasthttp.RequestHandler) fasthttp.RequestHandler
+
+// Chain acts as a list of fasthttp.RequestHandler constructors.
+// Chain is effectively immutable:
+// once created, it will always hold
+// the same set of constructors in the same order.
+type Chain struct {
+	constructors []Constructor
+	// ctx is the base context used for a request that doesn't already carry
+	// one of its own. See WithContext.
+	ctx context.Context
+}
+
+// New creates a new chain,
+// memorizing the given list of middleware constructors.
+// New serves no other function,
+// constructors are only called, on every request, by the handler
+// that Then() returns.
+func New(constructors ...Constructor) Chain {
+	c := Chain{ctx: context.Background()}
+	c.constructors = append(c.constructors, constructors...)
+
+	return c
+}
+
+// WithContext returns a new chain that uses ctx as the base context for
+// requests that haven't already had one stored on their RequestCtx.
+func (c Chain) WithContext(ctx context.Context) Chain {
+	newChain := c
+	newChain.ctx = ctx
+	return newChain
+}
+
+// Then chains the middleware and returns the final fasthttp.RequestHandler.
+//     New(m1, m2, m3).Then(h)
+// is equivalent to:
+//     m1(m2(m3(h)))
+//
+// The constructors are invoked per-request, using the context stored on the
+// fasthttp.RequestCtx (rc.UserValue) if one is already present, falling back
+// to the chain's base context otherwise. That context is then stored back on
+// rc so that middleware further down the chain, and the final handler, can
+// retrieve it the same way.
+//
+// nil is not allowed for Then()
+func (c Chain) Then(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if h == nil {
+		panic("nil is not allowed")
+	}
+
+	return func(rc *fasthttp.RequestCtx) {
+		ctx := c.ctx
+		if v, ok := rc.UserValue(ctxKey{}).(context.Context); ok && v != nil {
+			ctx = v
+		}
+		rc.SetUserValue(ctxKey{}, ctx)
+
+		final := h
+		for i := len(c.constructors) - 1; i >= 0; i-- {
+			final = c.constructors[i](ctx, final)
+		}
+		final(rc)
+	}
+}
+
+// ThenFunc works identically to Then, but takes
+// a plain func(*fasthttp.RequestCtx) instead of a fasthttp.RequestHandler.
+//
+// ThenFunc provides all the guarantees of Then.
+func (c Chain) ThenFunc(fn func(*fasthttp.RequestCtx)) fasthttp.RequestHandler {
+	if fn == nil {
+		return c.Then(nil)
+	}
+
+	return c.Then(fasthttp.RequestHandler(fn))
+}
+
+// Append extends a chain, adding the specified constructors
+// as the last ones in the request flow.
+//
+// Append returns a new chain, leaving the original one untouched.
+func (c Chain) Append(constructors ...Constructor) Chain {
+	newCons := make([]Constructor, len(c.constructors))
+	copy(newCons, c.constructors)
+	newCons = append(newCons, constructors...)
+
+	newChain := New(newCons...)
+	newChain.ctx = c.ctx
+	return newChain
+}
+
+// Extend returns a new chain consisting of the constructors in c followed by
+// the constructors in other, leaving both original chains untouched.
+func (c Chain) Extend(other Chain) Chain {
+	return c.Append(other.constructors...)
+}
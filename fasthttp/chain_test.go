@@ -0,0 +1,61 @@
+package fasthttp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// TestThenThreadsBaseContextToConstructorsAndFinalHandler verifies that
+// constructors run in order, and that the base context set via WithContext
+// is observed both by constructors and by the final handler, via the
+// RequestCtx.UserValue plumbing.
+func TestThenThreadsBaseContextToConstructorsAndFinalHandler(t *testing.T) {
+	type key struct{}
+	baseCtx := context.WithValue(context.Background(), key{}, "base-value")
+
+	var calls []string
+	var observed []interface{}
+
+	record := func(name string) Constructor {
+		return func(ctx context.Context, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+			return func(rc *fasthttp.RequestCtx) {
+				calls = append(calls, name)
+				observed = append(observed, ctx.Value(key{}))
+				next(rc)
+			}
+		}
+	}
+
+	final := func(rc *fasthttp.RequestCtx) {
+		calls = append(calls, "final")
+		v, _ := rc.UserValue(ctxKey{}).(context.Context)
+		if v != nil {
+			observed = append(observed, v.Value(key{}))
+		} else {
+			observed = append(observed, nil)
+		}
+	}
+
+	h := New(record("m1"), record("m2")).WithContext(baseCtx).Then(final)
+
+	var rc fasthttp.RequestCtx
+	h(&rc)
+
+	wantCalls := []string{"m1", "m2", "final"}
+	if len(calls) != len(wantCalls) {
+		t.Fatalf("call order = %v, want %v", calls, wantCalls)
+	}
+	for i := range wantCalls {
+		if calls[i] != wantCalls[i] {
+			t.Fatalf("call order = %v, want %v", calls, wantCalls)
+		}
+	}
+
+	for i, v := range observed {
+		if v != "base-value" {
+			t.Fatalf("observed[%d] (%s) = %v, want %q", i, calls[i], v, "base-value")
+		}
+	}
+}